@@ -0,0 +1,195 @@
+/*
+Copyright 2019 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package machine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// cacheMetadata records the manifest digest a cached image was written at, so LoadImages can tell a
+// stale or corrupt tarball from a good one, and CacheImage can skip re-pulling a tag that hasn't
+// moved since it was last cached.
+type cacheMetadata struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+}
+
+// metadataPath returns the sidecar metadata path for a cached image written to dst.
+func metadataPath(dst string) string {
+	return dst + ".metadata.json"
+}
+
+// writeCacheMetadata records the digest an image was cached at alongside it.
+func writeCacheMetadata(dst, image string, digest v1.Hash) error {
+	b, err := json.Marshal(cacheMetadata{Image: image, Digest: digest.String()})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metadataPath(dst), b, 0644)
+}
+
+// readCacheMetadata reads back the digest a cached image was written at.
+func readCacheMetadata(dst string) (*cacheMetadata, error) {
+	b, err := ioutil.ReadFile(metadataPath(dst))
+	if err != nil {
+		return nil, err
+	}
+	var m cacheMetadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// uptodate reports whether the image already cached at dst still matches what ref resolves to
+// remotely. It replaces the old "file exists, so skip" heuristic, which happily kept serving a
+// tarball whose tag had since moved, or that was only ever partially written.
+func uptodate(ref name.Reference, dst string) bool {
+	m, err := readCacheMetadata(dst)
+	if err != nil {
+		glog.Infof("no cache metadata for %s, treating as stale: %v", dst, err)
+		return false
+	}
+	head, err := remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		glog.Warningf("unable to HEAD %s to check for staleness, keeping cached copy: %v", ref, err)
+		return true
+	}
+	if head.Digest.String() == m.Digest {
+		return true
+	}
+	// For a multi-arch tag HEAD returns the index digest, while the cache recorded the digest of the
+	// platform image it pulled, so resolve the image itself before calling the cache stale.
+	img, err := remote.Image(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return false
+	}
+	digest, err := img.Digest()
+	return err == nil && digest.String() == m.Digest
+}
+
+// openCachedImage opens whatever is on disk at dst as a v1.Image, whether it was cached as a
+// docker-archive tarball (a file) or an OCI Image Layout (a directory).
+func openCachedImage(dst string) (v1.Image, error) {
+	info, err := os.Stat(dst)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		p, err := layout.FromPath(dst)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening oci layout")
+		}
+		return rootImage(p)
+	}
+	img, err := tarball.ImageFromPath(dst, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening cached tarball")
+	}
+	return img, nil
+}
+
+// rootImage returns the single image stored in an OCI Image Layout written by writeOCILayout: just
+// the one manifest AppendImage added.
+func rootImage(p layout.Path) (v1.Image, error) {
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading oci layout index")
+	}
+	im, err := idx.IndexManifest()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading oci layout manifest")
+	}
+	if len(im.Manifests) == 0 {
+		return nil, errors.Errorf("oci layout has no manifests")
+	}
+	return idx.Image(im.Manifests[0].Digest)
+}
+
+// cachedImageDigest recomputes the manifest digest of whatever is actually on disk at src, so it can
+// be checked against the recorded cacheMetadata before the image is trusted and sent to the guest VM.
+func cachedImageDigest(src string) (string, error) {
+	img, err := openCachedImage(src)
+	if err != nil {
+		return "", err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+	return digest.String(), nil
+}
+
+// verifyCachedDigest checks that the cached image at src still matches the digest it was cached at,
+// returning an error if it has been corrupted or replaced on disk. Images cached before digest
+// pinning was introduced have no sidecar metadata and are loaded unverified, as before.
+func verifyCachedDigest(src string) error {
+	m, err := readCacheMetadata(src)
+	if err != nil {
+		glog.Infof("no cache metadata for %s, skipping digest verification: %v", src, err)
+		return nil
+	}
+	actual, err := cachedImageDigest(src)
+	if err != nil {
+		return errors.Wrap(err, "computing cached image digest")
+	}
+	if actual != m.Digest {
+		return errors.Errorf("cached image %s has digest %s, expected %s recorded at cache time (cache may be stale or corrupt)", src, actual, m.Digest)
+	}
+	return nil
+}
+
+// CacheImageByDigest caches image pinned to an exact manifest digest, ignoring whatever the tag
+// currently resolves to. Use this instead of CacheImage when a caller needs reproducible,
+// tamper-evident caching of a known-good image, such as the addons subsystem pinning a specific
+// version rather than trusting a mutable tag.
+//
+// image is still cached under its plain "repo:tag" on disk, and its tag and cacheMetadata both still
+// record that tag-qualified string, same as CacheImage: only the fetch itself is pinned to digest.
+// That keeps digest-pinned images indistinguishable on disk from ordinary ones, so PruneCache,
+// CacheDiskUsage, and the registry mirror don't need to special-case them.
+func CacheImageByDigest(image, digest, cacheDir string) error {
+	fetchRef, err := pinnedReference(image, digest)
+	if err != nil {
+		return errors.Wrap(err, "building digest-pinned reference")
+	}
+
+	dst := filepath.Join(cacheDir, sanitizeCacheDir(image))
+	return cacheImage(image, fetchRef, dst, defaultCacheFormat)
+}
+
+// pinnedReference rewrites image's tag (if any) to the given digest, e.g.
+// "k8s.gcr.io/pause:3.2" + "sha256:abc..." -> "k8s.gcr.io/pause@sha256:abc...".
+func pinnedReference(image, digest string) (string, error) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", errors.Wrap(err, "creating docker image name")
+	}
+	return ref.Context().Name() + "@" + digest, nil
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package machine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestPinnedReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"k8s.gcr.io/pause:3.2", "k8s.gcr.io/pause@" + digest},
+		{"k8s.gcr.io/pause", "k8s.gcr.io/pause@" + digest},
+	}
+	for _, tc := range tests {
+		got, err := pinnedReference(tc.image, digest)
+		if err != nil {
+			t.Fatalf("pinnedReference(%q, %q): %v", tc.image, digest, err)
+		}
+		if got != tc.want {
+			t.Errorf("pinnedReference(%q, %q) = %q, want %q", tc.image, digest, got, tc.want)
+		}
+	}
+}
+
+// writeTestTarball caches a small random image at dst as a docker-archive tarball and records its
+// metadata, returning the image's digest.
+func writeTestTarball(t *testing.T, dst string) v1.Hash {
+	t.Helper()
+	img, err := random.Image(512, 2)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("img.Digest: %v", err)
+	}
+	tag, err := name.NewTag("test/image:v1", name.WeakValidation)
+	if err != nil {
+		t.Fatalf("name.NewTag: %v", err)
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatalf("os.Create: %v", err)
+	}
+	defer f.Close()
+	if err := tarball.Write(tag, img, &tarball.WriteOptions{}, f); err != nil {
+		t.Fatalf("tarball.Write: %v", err)
+	}
+	if err := writeCacheMetadata(dst, "test/image:v1", digest); err != nil {
+		t.Fatalf("writeCacheMetadata: %v", err)
+	}
+	return digest
+}
+
+func TestVerifyCachedDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-digest-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "test_image_v1")
+	digest := writeTestTarball(t, dst)
+
+	if err := verifyCachedDigest(dst); err != nil {
+		t.Errorf("verifyCachedDigest with matching digest returned error: %v", err)
+	}
+
+	wrong, err := v1.NewHash("sha256:" + strings.Repeat("0", 64))
+	if err != nil {
+		t.Fatalf("v1.NewHash: %v", err)
+	}
+	if wrong == digest {
+		t.Fatal("test setup produced a wrong digest equal to the real one")
+	}
+	if err := writeCacheMetadata(dst, "test/image:v1", wrong); err != nil {
+		t.Fatalf("writeCacheMetadata: %v", err)
+	}
+	if err := verifyCachedDigest(dst); err == nil {
+		t.Error("verifyCachedDigest with mismatched digest returned nil, want error")
+	}
+}
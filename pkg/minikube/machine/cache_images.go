@@ -32,6 +32,8 @@ import (
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/pkg/errors"
@@ -53,6 +55,23 @@ var getWindowsVolumeName = getWindowsVolumeNameCmd
 // loadImageLock is used to serialize image loads to avoid overloading the guest VM
 var loadImageLock sync.Mutex
 
+// CacheFormat describes how a cached image is laid out on disk.
+type CacheFormat string
+
+const (
+	// CacheFormatDockerTarball stores each cached image as a standalone docker-archive tarball. This is
+	// the long-standing default: simple, but images that share base layers duplicate them on disk.
+	CacheFormatDockerTarball CacheFormat = "docker-tarball"
+	// CacheFormatOCILayout stores each cached image as its own OCI Image Layout directory (index.json
+	// plus content-addressed blobs under blobs/sha256/). Each image's directory holds a full copy of
+	// its blobs; layers are not shared between the layout directories of different images.
+	CacheFormatOCILayout CacheFormat = "oci-layout"
+)
+
+// defaultCacheFormat is used by the format-less entry points so existing callers keep getting the
+// on-disk layout they always have.
+const defaultCacheFormat = CacheFormatDockerTarball
+
 // CacheImagesForBootstrapper will cache images for a bootstrapper
 func CacheImagesForBootstrapper(imageRepository string, version string, clusterBootstrapper string) error {
 	images := bootstrapper.GetCachedImageList(imageRepository, version, clusterBootstrapper)
@@ -70,13 +89,18 @@ func CacheImagesForBootstrapper(imageRepository string, version string, clusterB
 // For example, k8s.gcr.io/kube-addon-manager:v6.5 would be
 // stored at $CACHE_DIR/k8s.gcr.io/kube-addon-manager_v6.5
 func CacheImages(images []string, cacheDir string) error {
+	return CacheImagesWithFormat(images, cacheDir, defaultCacheFormat)
+}
+
+// CacheImagesWithFormat caches images on the host, writing each one to disk in the given CacheFormat.
+func CacheImagesWithFormat(images []string, cacheDir string, format CacheFormat) error {
 	var g errgroup.Group
 	for _, image := range images {
 		image := image
 		g.Go(func() error {
 			dst := filepath.Join(cacheDir, image)
 			dst = sanitizeCacheDir(dst)
-			if err := CacheImage(image, dst); err != nil {
+			if err := CacheImageWithFormat(image, dst, format); err != nil {
 				glog.Errorf("CacheImage %s -> %s failed: %v", image, dst, err)
 				return errors.Wrapf(err, "caching image %s", dst)
 			}
@@ -210,13 +234,45 @@ func getWindowsVolumeNameCmd(d string) (string, error) {
 	return vname, nil
 }
 
-// transferAndLoadImage transfers and loads a single image from the cache
+// transferAndLoadImage transfers and loads a single image from the cache. It detects whether the
+// image was cached as a docker-archive tarball or an OCI Image Layout directory and loads it
+// accordingly.
 func transferAndLoadImage(cr command.Runner, k8s config.KubernetesConfig, src string) error {
 	glog.Infof("Loading image from cache: %s", src)
-	filename := filepath.Base(src)
-	if _, err := os.Stat(src); err != nil {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = transferAndLoadOCILayout(cr, k8s, src)
+	} else {
+		err = transferAndLoadTarball(cr, k8s, src)
+	}
+	if err != nil {
 		return err
 	}
+	recordLoad(src)
+	return nil
+}
+
+// transferAndLoadTarball transfers a cached docker-archive tarball to the guest and loads it.
+func transferAndLoadTarball(cr command.Runner, k8s config.KubernetesConfig, src string) error {
+	if err := verifyCachedDigest(src); err != nil {
+		return errors.Wrap(err, "verifying cached image")
+	}
+
+	r, err := cruntime.New(cruntime.Config{Type: k8s.ContainerRuntime, Runner: cr})
+	if err != nil {
+		return errors.Wrap(err, "runtime")
+	}
+
+	return transferWholeTarball(cr, r, src)
+}
+
+// transferWholeTarball is the original, universally-supported path: copy the entire tarball over SSH
+// and hand it to the runtime's LoadImage.
+func transferWholeTarball(cr command.Runner, r cruntime.Manager, src string) error {
+	filename := filepath.Base(src)
 	dst := path.Join(loadRoot, filename)
 	f, err := assets.NewFileAsset(src, loadRoot, filename, "0644")
 	if err != nil {
@@ -226,15 +282,10 @@ func transferAndLoadImage(cr command.Runner, k8s config.KubernetesConfig, src st
 		return errors.Wrap(err, "transferring cached image")
 	}
 
-	r, err := cruntime.New(cruntime.Config{Type: k8s.ContainerRuntime, Runner: cr})
-	if err != nil {
-		return errors.Wrap(err, "runtime")
-	}
 	loadImageLock.Lock()
 	defer loadImageLock.Unlock()
 
-	err = r.LoadImage(dst)
-	if err != nil {
+	if err := r.LoadImage(dst); err != nil {
 		return errors.Wrapf(err, "%s load %s", r.Name(), dst)
 	}
 
@@ -242,15 +293,68 @@ func transferAndLoadImage(cr command.Runner, k8s config.KubernetesConfig, src st
 	return nil
 }
 
+// transferAndLoadOCILayout transfers a cached OCI Image Layout directory to the guest by re-encoding
+// it as a docker-archive tarball and handing that to transferWholeTarball. No runtime in this tree
+// (containerd included: `ctr images import` only ever reads a tar stream, never a layout directory)
+// has a native OCI layout importer, so every guest takes this path.
+func transferAndLoadOCILayout(cr command.Runner, k8s config.KubernetesConfig, src string) error {
+	if err := verifyCachedDigest(src); err != nil {
+		return errors.Wrap(err, "verifying cached image")
+	}
+
+	r, err := cruntime.New(cruntime.Config{Type: k8s.ContainerRuntime, Runner: cr})
+	if err != nil {
+		return errors.Wrap(err, "runtime")
+	}
+
+	return transferOCILayoutAsTarball(cr, r, src)
+}
+
+// transferOCILayoutAsTarball re-encodes the cached layout as a docker-archive tarball in a scratch
+// file and hands that to transferWholeTarball, the same path used for images cached as
+// CacheFormatDockerTarball in the first place.
+func transferOCILayoutAsTarball(cr command.Runner, r cruntime.Manager, src string) error {
+	p, err := layout.FromPath(src)
+	if err != nil {
+		return errors.Wrap(err, "opening oci layout")
+	}
+	img, err := rootImage(p)
+	if err != nil {
+		return errors.Wrap(err, "reading image from oci layout")
+	}
+
+	tmp, err := ioutil.TempFile("", filepath.Base(src)+".*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	tag, err := name.NewTag("oci-layout-cache/"+filepath.Base(src), name.WeakValidation)
+	if err != nil {
+		return err
+	}
+	if err := tarball.Write(tag, img, &tarball.WriteOptions{}, tmp); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing tarball from oci layout")
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return transferWholeTarball(cr, r, tmp.Name())
+}
+
 // DeleteFromImageCacheDir deletes images from the cache
 func DeleteFromImageCacheDir(images []string) error {
 	for _, image := range images {
 		path := filepath.Join(constants.ImageCacheDir, image)
 		path = sanitizeCacheDir(path)
 		glog.Infoln("Deleting image in cache at ", path)
-		if err := os.Remove(path); err != nil {
+		if err := os.RemoveAll(path); err != nil {
 			return err
 		}
+		os.Remove(metadataPath(path))
+		os.Remove(loadStatePath(path))
 	}
 	return cleanImageCacheDir()
 }
@@ -294,17 +398,41 @@ func getDstPath(dst string) (string, error) {
 	return dst, nil
 }
 
-// CacheImage caches an image
+// CacheImage caches an image in the default (docker-tarball) format
 func CacheImage(image, dst string) error {
+	return CacheImageWithFormat(image, dst, defaultCacheFormat)
+}
+
+// CacheImageWithFormat caches an image, writing it to dst in the given CacheFormat. For
+// CacheFormatDockerTarball, dst is the path to the tarball file. For CacheFormatOCILayout, dst is the
+// path to the OCI Image Layout directory.
+func CacheImageWithFormat(image, dst string, format CacheFormat) error {
+	return cacheImage(image, image, dst, format)
+}
+
+// cacheImage does the work behind CacheImageWithFormat. tagImage is what the cached image is tagged
+// and recorded in cacheMetadata as (a plain "repo:tag"); fetchRef is what's actually resolved and
+// pulled, which for CacheImageByDigest is a digest-pinned reference derived from tagImage. Keeping
+// the two separate means a digest pin never leaks into the tarball tag or the bookkeeping that
+// PruneCache and CacheDiskUsage key off of.
+func cacheImage(tagImage, fetchRef, dst string, format CacheFormat) error {
 	start := time.Now()
-	glog.Infof("CacheImage: %s -> %s", image, dst)
+	glog.Infof("CacheImage: %s -> %s (%s)", fetchRef, dst, format)
 	defer func() {
-		glog.Infof("CacheImage: %s -> %s completed in %s", image, dst, time.Since(start))
+		glog.Infof("CacheImage: %s -> %s completed in %s", fetchRef, dst, time.Since(start))
 	}()
 
+	ref, err := name.ParseReference(fetchRef, name.WeakValidation)
+	if err != nil {
+		return errors.Wrap(err, "creating docker image name")
+	}
+
 	if _, err := os.Stat(dst); err == nil {
-		glog.Infof("%s exists", dst)
-		return nil
+		if uptodate(ref, dst) {
+			glog.Infof("%s exists and is up to date", dst)
+			return nil
+		}
+		glog.Infof("%s exists but is stale, re-caching", dst)
 	}
 
 	dstPath, err := getDstPath(dst)
@@ -316,16 +444,31 @@ func CacheImage(image, dst string) error {
 		return errors.Wrapf(err, "making cache image directory: %s", dst)
 	}
 
-	ref, err := name.ParseReference(image, name.WeakValidation)
+	img, err := retrieveImage(ref)
 	if err != nil {
-		return errors.Wrap(err, "creating docker image name")
+		return errors.Wrap(err, "fetching image")
 	}
 
-	img, err := retrieveImage(ref)
+	digest, err := img.Digest()
 	if err != nil {
-		return errors.Wrap(err, "fetching image")
+		return errors.Wrap(err, "getting image digest")
 	}
 
+	switch format {
+	case CacheFormatOCILayout:
+		if err := writeOCILayout(img, dstPath); err != nil {
+			return err
+		}
+	default:
+		if err := writeTarball(tagImage, img, dstPath); err != nil {
+			return err
+		}
+	}
+	return writeCacheMetadata(dst, tagImage, digest)
+}
+
+// writeTarball writes img to dstPath as a docker-archive tarball, tagged with image.
+func writeTarball(image string, img v1.Image, dstPath string) error {
 	glog.Infoln("OPENING: ", dstPath)
 	f, err := ioutil.TempFile(filepath.Dir(dstPath), filepath.Base(dstPath)+".*.tmp")
 	if err != nil {
@@ -347,7 +490,40 @@ func CacheImage(image, dst string) error {
 	if err != nil {
 		return err
 	}
-	glog.Infof("%s exists", dst)
+	glog.Infof("%s exists", dstPath)
+	return nil
+}
+
+// writeOCILayout writes img to dstPath as an OCI Image Layout directory. It is built in a temporary
+// directory next to dstPath and renamed into place, replacing any stale layout already at dstPath,
+// the same way writeTarball handles its temp file, so a half-written layout is never observed by a
+// concurrent LoadImages.
+func writeOCILayout(img v1.Image, dstPath string) error {
+	tmp, err := ioutil.TempDir(filepath.Dir(dstPath), filepath.Base(dstPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	p, err := layout.Write(tmp, empty.Index)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return errors.Wrap(err, "initializing oci layout")
+	}
+	// The layout starts empty, so AppendImage writes every blob of img into this image's own
+	// directory.
+	if err := p.AppendImage(img); err != nil {
+		os.RemoveAll(tmp)
+		return errors.Wrap(err, "appending image to oci layout")
+	}
+	// rename(2) cannot replace a non-empty directory, so clear a stale layout being re-cached first.
+	if err := os.RemoveAll(dstPath); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dstPath); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	glog.Infof("%s exists", dstPath)
 	return nil
 }
 
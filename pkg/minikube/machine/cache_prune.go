@@ -0,0 +1,260 @@
+/*
+Copyright 2019 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package machine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// loadState records when a cached image was last loaded into a guest VM.
+type loadState struct {
+	LastLoaded time.Time `json:"lastLoaded"`
+}
+
+// loadStatePath returns the sidecar path recording when a cached image at src was last loaded.
+func loadStatePath(src string) string {
+	return src + ".loadstate.json"
+}
+
+// recordLoad updates src's load-state sidecar with the current time. Called by transferAndLoadImage
+// once a load succeeds, so PruneCache and CacheDiskUsage can tell how recently a cached image was
+// actually used rather than just when it was cached.
+func recordLoad(src string) {
+	b, err := json.Marshal(loadState{LastLoaded: time.Now()})
+	if err != nil {
+		glog.Warningf("marshaling load state for %s: %v", src, err)
+		return
+	}
+	if err := ioutil.WriteFile(loadStatePath(src), b, 0644); err != nil {
+		glog.Warningf("recording load state for %s: %v", src, err)
+	}
+}
+
+func readLoadState(src string) (*loadState, error) {
+	b, err := ioutil.ReadFile(loadStatePath(src))
+	if err != nil {
+		return nil, err
+	}
+	var s loadState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ImageDiskUsage describes the on-disk footprint of a single cached image, in the style of `podman
+// image df`.
+type ImageDiskUsage struct {
+	Image      string    `json:"image"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	LastLoaded time.Time `json:"lastLoaded,omitempty"`
+}
+
+// CacheDiskUsage reports per-image disk usage for every image cached under cacheDir that has a cache
+// metadata sidecar; images cached without one are not reported.
+func CacheDiskUsage(cacheDir string) ([]ImageDiskUsage, error) {
+	metas, err := findCacheMetadata(cacheDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "scanning cache directory")
+	}
+
+	var usage []ImageDiskUsage
+	for _, metaPath := range metas {
+		dst := strings.TrimSuffix(metaPath, ".metadata.json")
+		m, err := readCacheMetadata(dst)
+		if err != nil {
+			glog.Warningf("reading cache metadata for %s: %v", dst, err)
+			continue
+		}
+		size, err := dirOrFileSize(dst)
+		if err != nil {
+			glog.Warningf("sizing %s: %v", dst, err)
+			continue
+		}
+		u := ImageDiskUsage{Image: m.Image, Path: dst, Size: size}
+		if ls, err := readLoadState(dst); err == nil {
+			u.LastLoaded = ls.LastLoaded
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+// findCacheMetadata returns the path of every cache metadata sidecar under cacheDir, one per cached
+// image.
+func findCacheMetadata(cacheDir string) ([]string, error) {
+	var metas []string
+	err := filepath.Walk(cacheDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// The path may have been removed concurrently (e.g. by another prune); skip it.
+			return nil
+		}
+		if !fi.IsDir() && strings.HasSuffix(p, ".metadata.json") {
+			metas = append(metas, p)
+		}
+		return nil
+	})
+	return metas, err
+}
+
+// dirOrFileSize returns the total size on disk of path, which may be a single tarball file
+// (CacheFormatDockerTarball) or an OCI layout directory (CacheFormatOCILayout).
+func dirOrFileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.IsDir() {
+		return fi.Size(), nil
+	}
+	var total int64
+	err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// PruneOptions selects which cached images PruneCache removes. Filters compose: an image is removed
+// if it matches any filter that's enabled (zero value disables a filter).
+type PruneOptions struct {
+	// Until removes images whose last load is older than this, or that have never been loaded.
+	Until time.Duration
+	// Dangling removes any cached image whose tag isn't a key in Referenced. Callers are expected to
+	// build Referenced from the expected image list (e.g. bootstrapper.GetCachedImageList) across
+	// every profile, since a single profile's config isn't enough to know what's still in use.
+	Dangling   bool
+	Referenced map[string]bool
+	// KeepLatest keeps only the N most-recently-loaded images per repository (image name without
+	// tag), pruning the rest.
+	KeepLatest int
+	// MaxSize evicts the least-recently-loaded images, oldest first, until total cache usage is at or
+	// below this many bytes.
+	MaxSize int64
+}
+
+// PruneCache removes cached images under cacheDir matching opts, returning the paths it deleted.
+func PruneCache(cacheDir string, opts PruneOptions) ([]string, error) {
+	usage, err := CacheDiskUsage(cacheDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting cache disk usage")
+	}
+
+	toRemove := map[string]bool{}
+
+	if opts.Until > 0 {
+		cutoff := time.Now().Add(-opts.Until)
+		for _, u := range usage {
+			if u.LastLoaded.IsZero() || u.LastLoaded.Before(cutoff) {
+				toRemove[u.Path] = true
+			}
+		}
+	}
+
+	if opts.Dangling {
+		for _, u := range usage {
+			if !opts.Referenced[u.Image] {
+				toRemove[u.Path] = true
+			}
+		}
+	}
+
+	if opts.KeepLatest > 0 {
+		byRepo := map[string][]ImageDiskUsage{}
+		for _, u := range usage {
+			repo := repoWithoutTag(u.Image)
+			byRepo[repo] = append(byRepo[repo], u)
+		}
+		for _, imgs := range byRepo {
+			sort.Slice(imgs, func(i, j int) bool { return imgs[i].LastLoaded.After(imgs[j].LastLoaded) })
+			if len(imgs) > opts.KeepLatest {
+				for _, u := range imgs[opts.KeepLatest:] {
+					toRemove[u.Path] = true
+				}
+			}
+		}
+	}
+
+	if opts.MaxSize > 0 {
+		var total int64
+		for _, u := range usage {
+			if !toRemove[u.Path] {
+				total += u.Size
+			}
+		}
+		if total > opts.MaxSize {
+			oldest := append([]ImageDiskUsage(nil), usage...)
+			sort.Slice(oldest, func(i, j int) bool { return oldest[i].LastLoaded.Before(oldest[j].LastLoaded) })
+			for _, u := range oldest {
+				if total <= opts.MaxSize {
+					break
+				}
+				if toRemove[u.Path] {
+					continue
+				}
+				toRemove[u.Path] = true
+				total -= u.Size
+			}
+		}
+	}
+
+	var removed []string
+	for path := range toRemove {
+		if err := os.RemoveAll(path); err != nil {
+			return removed, errors.Wrapf(err, "removing %s", path)
+		}
+		os.Remove(metadataPath(path))
+		os.Remove(loadStatePath(path))
+		glog.Infof("pruned cached image %s", path)
+		removed = append(removed, path)
+	}
+	if err := cleanImageCacheDir(); err != nil {
+		glog.Warningf("cleaning empty cache directories: %v", err)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// repoWithoutTag strips a trailing ":tag" or "@digest" from image, leaving the bare repository name
+// used to group images for the --keep-latest filter. Cached images are always recorded under their
+// tag-qualified name (see cacheImage), but this also tolerates a "repo@sha256:..." form so a stray
+// digest reference doesn't get mis-split at the colon inside the digest and grouped under
+// "repo@sha256".
+func repoWithoutTag(image string) string {
+	if i := strings.LastIndex(image, "@"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
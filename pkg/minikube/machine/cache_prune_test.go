@@ -0,0 +1,145 @@
+/*
+Copyright 2019 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package machine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepoWithoutTag(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"k8s.gcr.io/pause:3.2", "k8s.gcr.io/pause"},
+		{"k8s.gcr.io/pause", "k8s.gcr.io/pause"},
+		{"k8s.gcr.io/pause@sha256:abc123", "k8s.gcr.io/pause"},
+		{"localhost:5000/pause:3.2", "localhost:5000/pause"},
+	}
+	for _, tc := range tests {
+		if got := repoWithoutTag(tc.image); got != tc.want {
+			t.Errorf("repoWithoutTag(%q) = %q, want %q", tc.image, got, tc.want)
+		}
+	}
+}
+
+// cacheTestImage caches a small random image at cacheDir/name as a docker-archive tarball, records it
+// in its cache metadata under its own name (the tarball's tag stays writeTestTarball's hardcoded
+// "test/image:v1"), and records loadedAt as its
+// last-loaded time so PruneCache's Until and KeepLatest filters have something to compare against.
+func cacheTestImage(t *testing.T, cacheDir, name string, loadedAt time.Time) string {
+	t.Helper()
+	dst := sanitizeCacheDir(filepath.Join(cacheDir, name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	digest := writeTestTarball(t, dst)
+	if err := writeCacheMetadata(dst, name, digest); err != nil {
+		t.Fatalf("writeCacheMetadata: %v", err)
+	}
+	b, err := json.Marshal(loadState{LastLoaded: loadedAt})
+	if err != nil {
+		t.Fatalf("marshaling load state: %v", err)
+	}
+	if err := ioutil.WriteFile(loadStatePath(dst), b, 0644); err != nil {
+		t.Fatalf("writing load state: %v", err)
+	}
+	return dst
+}
+
+func TestPruneCacheUntil(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-prune-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	old := cacheTestImage(t, dir, "k8s.gcr.io/old:v1", now.Add(-48*time.Hour))
+	fresh := cacheTestImage(t, dir, "k8s.gcr.io/fresh:v1", now)
+
+	removed, err := PruneCache(dir, PruneOptions{Until: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("PruneCache: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != old {
+		t.Errorf("PruneCache(Until: 24h) removed %v, want [%s]", removed, old)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after prune", old)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("%s was unexpectedly removed: %v", fresh, err)
+	}
+}
+
+func TestPruneCacheDangling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-prune-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	kept := cacheTestImage(t, dir, "k8s.gcr.io/kept:v1", now)
+	dangling := cacheTestImage(t, dir, "k8s.gcr.io/dangling:v1", now)
+
+	removed, err := PruneCache(dir, PruneOptions{
+		Dangling:   true,
+		Referenced: map[string]bool{"k8s.gcr.io/kept:v1": true},
+	})
+	if err != nil {
+		t.Fatalf("PruneCache: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != dangling {
+		t.Errorf("PruneCache(Dangling) removed %v, want [%s]", removed, dangling)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("%s was unexpectedly removed: %v", kept, err)
+	}
+}
+
+func TestPruneCacheKeepLatest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-prune-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	v1 := cacheTestImage(t, dir, "k8s.gcr.io/pause:v1", now.Add(-2*time.Hour))
+	v2 := cacheTestImage(t, dir, "k8s.gcr.io/pause:v2", now.Add(-1*time.Hour))
+	v3 := cacheTestImage(t, dir, "k8s.gcr.io/pause:v3", now)
+
+	removed, err := PruneCache(dir, PruneOptions{KeepLatest: 2})
+	if err != nil {
+		t.Fatalf("PruneCache: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != v1 {
+		t.Errorf("PruneCache(KeepLatest: 2) removed %v, want [%s]", removed, v1)
+	}
+	for _, kept := range []string{v2, v3} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("%s was unexpectedly removed: %v", kept, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2019 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package machine
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/minikube/pkg/minikube/command"
+	"k8s.io/minikube/pkg/minikube/cruntime"
+)
+
+// containerdCacheAdapter gives the image cache's containerd-specific registry-mirror configuration
+// something real to call. docker and CRI-O guests get no adapter, so ConfigureGuestRegistryMirror
+// returns an error for them and their cached images reach the guest only through the whole-tarball
+// load path; CRI-O's registries.conf mirror configuration is not implemented here.
+type containerdCacheAdapter struct {
+	cruntime.Manager
+	cr command.Runner
+}
+
+// newContainerdCacheAdapter returns a containerdCacheAdapter for cr/r when containerRuntime is
+// "containerd", or nil otherwise. ConfigureGuestRegistryMirror reports a nil return as an error,
+// meaning the runtime does not support registry mirrors.
+func newContainerdCacheAdapter(cr command.Runner, r cruntime.Manager, containerRuntime string) *containerdCacheAdapter {
+	if containerRuntime != "containerd" {
+		return nil
+	}
+	return &containerdCacheAdapter{Manager: r, cr: cr}
+}
+
+// SetRegistryMirror implements mirrorableRuntime by adding addr as a registry-mirrors endpoint to
+// containerd's config.toml and restarting it to pick up the change.
+func (c *containerdCacheAdapter) SetRegistryMirror(addr string) error {
+	cfg := fmt.Sprintf(`
+[plugins."io.containerd.grpc.v1.cri".registry.mirrors."_default"]
+  endpoint = ["http://%s"]
+`, addr)
+	tee := exec.Command("sudo", "tee", "-a", "/etc/containerd/config.toml")
+	tee.Stdin = strings.NewReader(cfg)
+	if _, err := c.cr.RunCmd(tee); err != nil {
+		return errors.Wrap(err, "writing containerd registry mirror config")
+	}
+	if _, err := c.cr.RunCmd(exec.Command("sudo", "systemctl", "restart", "containerd")); err != nil {
+		return errors.Wrap(err, "restarting containerd")
+	}
+	return nil
+}
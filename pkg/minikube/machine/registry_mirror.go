@@ -0,0 +1,340 @@
+/*
+Copyright 2019 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package machine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"k8s.io/minikube/pkg/minikube/command"
+	"k8s.io/minikube/pkg/minikube/config"
+	"k8s.io/minikube/pkg/minikube/cruntime"
+)
+
+// RegistryMirror serves constants.ImageCacheDir as an OCI distribution v2 registry on the host, so
+// the guest's container runtime can pull cached images over the host-only network the same way
+// production clusters pull through a mirror, instead of minikube copying tarballs into the VM. Blobs
+// are served read-only from the cache; blob uploads are not accepted locally. Manifests live in the
+// registry's in-memory index, which accepts manifest pushes from any client (seedManifests fills it
+// that way). A cache miss falls back to upstream, the one registry this mirror instance fronts.
+type RegistryMirror struct {
+	ln  net.Listener
+	srv *http.Server
+}
+
+// StartRegistryMirror starts serving cacheDir as a registry, listening on all interfaces so the guest
+// VM can reach it over the host-only network, and returns the handle used to address and stop it
+// again. Any pull the cache can't satisfy is relayed to upstream (a registry host, e.g.
+// "k8s.gcr.io"), so the mirror never turns a cache miss into a failed pull.
+func StartRegistryMirror(cacheDir, upstream string) (*RegistryMirror, error) {
+	ln, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "listening for registry mirror")
+	}
+	local := registry.New(registry.WithBlobHandler(newCacheBlobHandler(cacheDir)))
+	srv := &http.Server{Handler: newFallbackHandler(local, upstream)}
+	m := &RegistryMirror{ln: ln, srv: srv}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("registry mirror stopped: %v", err)
+		}
+	}()
+	glog.Infof("registry mirror for %s (upstream %s) listening on %s", cacheDir, upstream, ln.Addr())
+
+	if err := m.seedManifests(cacheDir); err != nil {
+		glog.Warningf("seeding registry mirror with already-cached images: %v", err)
+	}
+	return m, nil
+}
+
+// Addr returns the host:port the mirror is listening on.
+func (m *RegistryMirror) Addr() string {
+	return m.ln.Addr().String()
+}
+
+// Stop gracefully shuts the mirror down.
+func (m *RegistryMirror) Stop() error {
+	return m.srv.Shutdown(context.Background())
+}
+
+// seedManifests pushes every image already cached under cacheDir into the mirror's own tag/digest
+// index, so a guest pull resolves immediately instead of 404ing until something else PUTs the
+// manifest first. cacheBlobHandler already serves every blob the image needs, so remote.Write's
+// existence check (HEAD before PUT) skips re-uploading any of them - only the small manifest itself
+// crosses the loopback connection.
+func (m *RegistryMirror) seedManifests(cacheDir string) error {
+	imgs, err := cachedImages(cacheDir)
+	if err != nil {
+		return errors.Wrap(err, "listing cached images")
+	}
+	addr := "127.0.0.1:" + strconv.Itoa(m.ln.Addr().(*net.TCPAddr).Port)
+	for tagName, img := range imgs {
+		ref, err := name.ParseReference(tagName, name.WeakValidation)
+		if err != nil {
+			glog.Warningf("parsing %s to seed registry mirror: %v", tagName, err)
+			continue
+		}
+		tag, ok := ref.(name.Tag)
+		if !ok {
+			// Digest-pinned images are always cached under their tag-qualified name too (see
+			// cacheImage), so this shouldn't happen in practice; skip rather than fail the whole mirror.
+			glog.Warningf("%s has no tag to seed registry mirror under, skipping", tagName)
+			continue
+		}
+		mirrorTag, err := name.NewTag(addr+"/"+tag.RepositoryStr()+":"+tag.TagStr(), name.WeakValidation)
+		if err != nil {
+			glog.Warningf("building mirror-local tag for %s: %v", tagName, err)
+			continue
+		}
+		if err := remote.Write(mirrorTag, img); err != nil {
+			glog.Warningf("seeding registry mirror with %s: %v", tagName, err)
+			continue
+		}
+	}
+	return nil
+}
+
+// mirrorableRuntime is implemented by container runtimes that can be pointed at an additional
+// registry mirror. The only implementation today is containerdCacheAdapter, via its
+// registry-mirrors config.
+type mirrorableRuntime interface {
+	cruntime.Manager
+	// SetRegistryMirror configures addr ("host:port") as a pull-through mirror, falling back to the
+	// upstream registry on a cache miss.
+	SetRegistryMirror(addr string) error
+}
+
+// ConfigureGuestRegistryMirror points the guest's container runtime at mirror, so image pulls that
+// hit the local cache are served from it instead of the upstream registry.
+func ConfigureGuestRegistryMirror(cr command.Runner, k8s config.KubernetesConfig, mirror *RegistryMirror) error {
+	r, err := cruntime.New(cruntime.Config{Type: k8s.ContainerRuntime, Runner: cr})
+	if err != nil {
+		return errors.Wrap(err, "runtime")
+	}
+	mr := newContainerdCacheAdapter(cr, r, k8s.ContainerRuntime)
+	if mr == nil {
+		return errors.Errorf("%s does not support registry mirrors", r.Name())
+	}
+	return mr.SetRegistryMirror(mirror.Addr())
+}
+
+// cachedImages returns the v1.Image for every image cached under cacheDir, keyed by the tag-qualified
+// name it was cached under (see cacheMetadata.Image), regardless of which CacheFormat it was written
+// in.
+func cachedImages(cacheDir string) (map[string]v1.Image, error) {
+	metas, err := findCacheMetadata(cacheDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "scanning cache directory")
+	}
+	imgs := map[string]v1.Image{}
+	for _, metaPath := range metas {
+		dst := strings.TrimSuffix(metaPath, ".metadata.json")
+		m, err := readCacheMetadata(dst)
+		if err != nil {
+			glog.Warningf("reading cache metadata for %s: %v", dst, err)
+			continue
+		}
+		img, err := openCachedImage(dst)
+		if err != nil {
+			glog.Warningf("opening cached image %s: %v", dst, err)
+			continue
+		}
+		imgs[m.Image] = img
+	}
+	return imgs, nil
+}
+
+// blobSource is how cacheBlobHandler serves a single blob's content once it's located it, without
+// caring whether the blob came from a docker-archive tarball or an OCI Image Layout on disk.
+type blobSource struct {
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+// cacheBlobHandler implements registry.BlobHandler by serving every manifest, config, and layer blob
+// of every image cached under cacheDir, in whichever CacheFormat it was written. The index is built
+// once, from the images on disk at the time of the first blob request.
+type cacheBlobHandler struct {
+	cacheDir string
+
+	mu    sync.Mutex
+	index map[string]blobSource // digest -> blob content, built lazily
+}
+
+func newCacheBlobHandler(cacheDir string) *cacheBlobHandler {
+	return &cacheBlobHandler{cacheDir: cacheDir}
+}
+
+// ensureIndex builds b.index from the cached images on disk, the first time it's needed.
+func (b *cacheBlobHandler) ensureIndex() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.index != nil {
+		return nil
+	}
+	imgs, err := cachedImages(b.cacheDir)
+	if err != nil {
+		return err
+	}
+	index := map[string]blobSource{}
+	for _, img := range imgs {
+		if manifest, err := img.RawManifest(); err == nil {
+			if digest, err := img.Digest(); err == nil {
+				index[digest.String()] = blobSource{size: int64(len(manifest)), open: byteBlob(manifest)}
+			}
+		}
+		if config, err := img.RawConfigFile(); err == nil {
+			if digest, err := img.ConfigName(); err == nil {
+				index[digest.String()] = blobSource{size: int64(len(config)), open: byteBlob(config)}
+			}
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			glog.Warningf("listing layers of a cached image: %v", err)
+			continue
+		}
+		for _, layer := range layers {
+			layer := layer
+			digest, err := layer.Digest()
+			if err != nil {
+				continue
+			}
+			size, err := layer.Size()
+			if err != nil {
+				continue
+			}
+			index[digest.String()] = blobSource{size: size, open: layer.Compressed}
+		}
+	}
+	b.index = index
+	return nil
+}
+
+// byteBlob returns a blobSource.open func that serves b's content, for the small, already-in-memory
+// manifest and config blobs.
+func byteBlob(b []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+func (b *cacheBlobHandler) locate(h v1.Hash) (blobSource, error) {
+	if err := b.ensureIndex(); err != nil {
+		return blobSource{}, err
+	}
+	b.mu.Lock()
+	src, ok := b.index[h.String()]
+	b.mu.Unlock()
+	if !ok {
+		return blobSource{}, errors.Errorf("blob %s not found in cache", h)
+	}
+	return src, nil
+}
+
+// Get returns the content of the blob with the given digest.
+func (b *cacheBlobHandler) Get(_ context.Context, _ string, h v1.Hash) (io.ReadCloser, error) {
+	src, err := b.locate(h)
+	if err != nil {
+		return nil, err
+	}
+	return src.open()
+}
+
+// Stat returns the size of the blob with the given digest, without fetching its content.
+func (b *cacheBlobHandler) Stat(_ context.Context, _ string, h v1.Hash) (int64, error) {
+	src, err := b.locate(h)
+	if err != nil {
+		return 0, err
+	}
+	return src.size, nil
+}
+
+// responseRecorder buffers a handler's response so fallbackHandler can inspect the status code before
+// deciding whether to relay it to the real client or discard it and try upstream instead.
+type responseRecorder struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}, statusCode: http.StatusOK}
+}
+
+func (r *responseRecorder) Header() http.Header { return r.header }
+
+func (r *responseRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+
+func (r *responseRecorder) WriteHeader(code int) { r.statusCode = code }
+
+func (r *responseRecorder) flushTo(w http.ResponseWriter) {
+	for k, vs := range r.header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(r.statusCode)
+	w.Write(r.body.Bytes()) // nolint: errcheck
+}
+
+// fallbackHandler tries the local cache-backed registry first, and transparently reverse-proxies to
+// upstream on anything but a 2xx, so a cache miss behaves like an ordinary pull-through mirror instead
+// of failing the pull outright.
+type fallbackHandler struct {
+	local    http.Handler
+	upstream *httputil.ReverseProxy
+}
+
+func newFallbackHandler(local http.Handler, upstream string) *fallbackHandler {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "https", Host: upstream})
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		// NewSingleHostReverseProxy keeps the client's Host header, which names this mirror.
+		req.Host = upstream
+	}
+	return &fallbackHandler{
+		local:    local,
+		upstream: proxy,
+	}
+}
+
+func (f *fallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := newResponseRecorder()
+	f.local.ServeHTTP(rec, r)
+	if rec.statusCode >= 200 && rec.statusCode < 300 {
+		rec.flushTo(w)
+		return
+	}
+	glog.Infof("registry mirror cache miss for %s (local status %d), falling back to upstream", r.URL.Path, rec.statusCode)
+	f.upstream.ServeHTTP(w, r)
+}